@@ -0,0 +1,49 @@
+// Package accounts persists player identity and lifetime stats across
+// rooms and games, replacing the old model where a client's display name
+// (Blob.FirstName) was trusted as-is and all state died with the room.
+package accounts
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("accounts: invalid credentials")
+	ErrUnknownPlayer      = errors.New("accounts: unknown player")
+)
+
+// PlayerProfile is the durable record for one player, returned to the
+// client after a successful login and updated as they play.
+type PlayerProfile struct {
+	Id          string
+	Name        string
+	Score       int
+	GamesPlayed int
+	Wins        int
+	LastSeen    time.Time
+}
+
+// Service is the interface Room depends on for login and score
+// bookkeeping, so tests can swap in an in-memory implementation instead
+// of standing up a database.
+type Service interface {
+	// Authenticate verifies name/password, creating the account on first
+	// login. It returns ErrInvalidCredentials if the password doesn't
+	// match an existing account.
+	Authenticate(name, password string) (PlayerProfile, error)
+	// Profile looks up a player by id, e.g. to resume a session token.
+	Profile(id string) (PlayerProfile, error)
+	// ApplyScoreDelta adds delta (positive or negative) to the player's
+	// lifetime score.
+	ApplyScoreDelta(id string, delta int) error
+	// RecordGameResult increments GamesPlayed, and Wins if won.
+	RecordGameResult(id string, won bool) error
+	// Leaderboard returns up to n profiles ordered by Score descending.
+	Leaderboard(n int) ([]PlayerProfile, error)
+}
+
+func sortProfilesByScore(ps []PlayerProfile) {
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Score > ps[j].Score })
+}
@@ -0,0 +1,102 @@
+package accounts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type memoryRecord struct {
+	profile      PlayerProfile
+	passwordHash []byte
+}
+
+// MemoryService is an in-memory Service, for tests and for running the
+// server without a database.
+type MemoryService struct {
+	mu     sync.Mutex
+	nextId int
+	byName map[string]*memoryRecord
+	byId   map[string]*memoryRecord
+}
+
+func NewMemoryService() *MemoryService {
+	return &MemoryService{
+		byName: map[string]*memoryRecord{},
+		byId:   map[string]*memoryRecord{},
+	}
+}
+
+func (s *MemoryService) Authenticate(name, password string) (PlayerProfile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.byName[name]
+	if !ok {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return PlayerProfile{}, err
+		}
+		s.nextId++
+		rec = &memoryRecord{
+			profile:      PlayerProfile{Id: fmt.Sprintf("p%d", s.nextId), Name: name},
+			passwordHash: hash,
+		}
+		s.byName[name] = rec
+		s.byId[rec.profile.Id] = rec
+	} else if bcrypt.CompareHashAndPassword(rec.passwordHash, []byte(password)) != nil {
+		return PlayerProfile{}, ErrInvalidCredentials
+	}
+	rec.profile.LastSeen = time.Now()
+	return rec.profile, nil
+}
+
+func (s *MemoryService) Profile(id string) (PlayerProfile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.byId[id]
+	if !ok {
+		return PlayerProfile{}, ErrUnknownPlayer
+	}
+	return rec.profile, nil
+}
+
+func (s *MemoryService) ApplyScoreDelta(id string, delta int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.byId[id]
+	if !ok {
+		return ErrUnknownPlayer
+	}
+	rec.profile.Score += delta
+	return nil
+}
+
+func (s *MemoryService) RecordGameResult(id string, won bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.byId[id]
+	if !ok {
+		return ErrUnknownPlayer
+	}
+	rec.profile.GamesPlayed++
+	if won {
+		rec.profile.Wins++
+	}
+	return nil
+}
+
+func (s *MemoryService) Leaderboard(n int) ([]PlayerProfile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]PlayerProfile, 0, len(s.byId))
+	for _, rec := range s.byId {
+		all = append(all, rec.profile)
+	}
+	sortProfilesByScore(all)
+	if n > 0 && n < len(all) {
+		all = all[:n]
+	}
+	return all, nil
+}
@@ -0,0 +1,170 @@
+package accounts
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // pure-Go driver, no cgo
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SQLiteService is the persistent Service backing, used in production so
+// scores and profiles survive a server restart.
+type SQLiteService struct {
+	db *sql.DB
+}
+
+func NewSQLiteService(path string) (*SQLiteService, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// Room loops fire ApplyScoreDelta / RecordGameResult off in their own
+	// goroutines, so concurrent rooms (and claims within one room) can
+	// issue concurrent writes to this one file. SQLite only allows one writer
+	// at a time; capping the pool at a single connection serializes them
+	// through database/sql instead of racing to SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS players (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			name          TEXT UNIQUE NOT NULL,
+			password_hash BLOB NOT NULL,
+			score         INTEGER NOT NULL DEFAULT 0,
+			games_played  INTEGER NOT NULL DEFAULT 0,
+			wins          INTEGER NOT NULL DEFAULT 0,
+			last_seen     DATETIME
+		)
+	`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteService{db: db}, nil
+}
+
+func (s *SQLiteService) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteService) scan(row *sql.Row) (PlayerProfile, error) {
+	var (
+		p        PlayerProfile
+		lastSeen sql.NullTime
+	)
+	if err := row.Scan(&p.Id, &p.Name, &p.Score, &p.GamesPlayed, &p.Wins, &lastSeen); err != nil {
+		if err == sql.ErrNoRows {
+			return PlayerProfile{}, ErrUnknownPlayer
+		}
+		return PlayerProfile{}, err
+	}
+	if lastSeen.Valid {
+		p.LastSeen = lastSeen.Time
+	}
+	return p, nil
+}
+
+func (s *SQLiteService) byName(name string) (PlayerProfile, []byte, error) {
+	var (
+		p            PlayerProfile
+		passwordHash []byte
+		lastSeen     sql.NullTime
+	)
+	row := s.db.QueryRow(`SELECT id, name, password_hash, score, games_played, wins, last_seen FROM players WHERE name = ?`, name)
+	if err := row.Scan(&p.Id, &p.Name, &passwordHash, &p.Score, &p.GamesPlayed, &p.Wins, &lastSeen); err != nil {
+		return PlayerProfile{}, nil, err
+	}
+	if lastSeen.Valid {
+		p.LastSeen = lastSeen.Time
+	}
+	return p, passwordHash, nil
+}
+
+func (s *SQLiteService) Authenticate(name, password string) (PlayerProfile, error) {
+	profile, hash, err := s.byName(name)
+	if err == sql.ErrNoRows {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return PlayerProfile{}, err
+		}
+		res, err := s.db.Exec(`INSERT INTO players (name, password_hash, last_seen) VALUES (?, ?, ?)`, name, hash, time.Now())
+		if err != nil {
+			return PlayerProfile{}, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return PlayerProfile{}, err
+		}
+		return PlayerProfile{Id: fmt.Sprint(id), Name: name}, nil
+	}
+	if err != nil {
+		return PlayerProfile{}, err
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return PlayerProfile{}, ErrInvalidCredentials
+	}
+	if _, err := s.db.Exec(`UPDATE players SET last_seen = ? WHERE id = ?`, time.Now(), profile.Id); err != nil {
+		return PlayerProfile{}, err
+	}
+	profile.LastSeen = time.Now()
+	return profile, nil
+}
+
+func (s *SQLiteService) Profile(id string) (PlayerProfile, error) {
+	row := s.db.QueryRow(`SELECT id, name, score, games_played, wins, last_seen FROM players WHERE id = ?`, id)
+	return s.scan(row)
+}
+
+func (s *SQLiteService) ApplyScoreDelta(id string, delta int) error {
+	res, err := s.db.Exec(`UPDATE players SET score = score + ? WHERE id = ?`, delta, id)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res)
+}
+
+func (s *SQLiteService) RecordGameResult(id string, won bool) error {
+	win := 0
+	if won {
+		win = 1
+	}
+	res, err := s.db.Exec(`UPDATE players SET games_played = games_played + 1, wins = wins + ? WHERE id = ?`, win, id)
+	if err != nil {
+		return err
+	}
+	return checkRowsAffected(res)
+}
+
+func (s *SQLiteService) Leaderboard(n int) ([]PlayerProfile, error) {
+	rows, err := s.db.Query(`SELECT id, name, score, games_played, wins, last_seen FROM players ORDER BY score DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PlayerProfile
+	for rows.Next() {
+		var (
+			p        PlayerProfile
+			lastSeen sql.NullTime
+		)
+		if err := rows.Scan(&p.Id, &p.Name, &p.Score, &p.GamesPlayed, &p.Wins, &lastSeen); err != nil {
+			return nil, err
+		}
+		if lastSeen.Valid {
+			p.LastSeen = lastSeen.Time
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func checkRowsAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUnknownPlayer
+	}
+	return nil
+}
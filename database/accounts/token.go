@@ -0,0 +1,57 @@
+package accounts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenSigner issues and verifies the session tokens handed back to
+// clients after a successful login, so a reconnect can skip the
+// name/password round trip.
+type TokenSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+const defaultTokenTTL = 30 * 24 * time.Hour
+
+func NewTokenSigner(secret []byte) *TokenSigner {
+	return &TokenSigner{secret: secret, ttl: defaultTokenTTL}
+}
+
+// Sign produces a token of the form "<playerId>.<expiry>.<signature>".
+func (s *TokenSigner) Sign(playerId string) string {
+	expiry := time.Now().Add(s.ttl).Unix()
+	payload := fmt.Sprintf("%s.%d", playerId, expiry)
+	return payload + "." + s.sign(payload)
+}
+
+// Verify returns the player id encoded in token if its signature is valid
+// and it hasn't expired.
+func (s *TokenSigner) Verify(token string) (string, bool) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	playerId, expiryStr, sig := parts[0], parts[1], parts[2]
+	payload := playerId + "." + expiryStr
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", false
+	}
+	return playerId, true
+}
+
+func (s *TokenSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
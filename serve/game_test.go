@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// digits encodes a card's base-v.Values attribute digits, low attribute
+// index (0) first, mirroring the place-value order isMatch unpacks with
+// repeated %v.Values / v.Values.
+func digits(v Variant, ds ...int) int {
+	c, place := 0, 1
+	for _, d := range ds {
+		c += d * place
+		place *= v.Values
+	}
+	return c
+}
+
+func TestIsMatchVariantPresets(t *testing.T) {
+	tests := []struct {
+		name    string
+		variant Variant
+		cards   []int
+		want    bool
+	}{
+		{
+			name:    "default: first attribute distinct, others equal",
+			variant: DefaultVariant,
+			cards:   []int{digits(DefaultVariant, 0, 0, 0, 0), digits(DefaultVariant, 1, 0, 0, 0), digits(DefaultVariant, 2, 0, 0, 0)},
+			want:    true,
+		},
+		{
+			name:    "default: last attribute distinct, others equal",
+			variant: DefaultVariant,
+			cards:   []int{digits(DefaultVariant, 0, 0, 0, 0), digits(DefaultVariant, 0, 0, 0, 1), digits(DefaultVariant, 0, 0, 0, 2)},
+			want:    true,
+		},
+		{
+			name:    "default: one attribute neither equal nor distinct",
+			variant: DefaultVariant,
+			cards:   []int{digits(DefaultVariant, 0, 0, 0, 0), digits(DefaultVariant, 0, 0, 0, 0), digits(DefaultVariant, 1, 0, 0, 0)},
+			want:    false,
+		},
+		{
+			name:    "four-card: first attribute distinct, others equal",
+			variant: FourCardVariant,
+			cards: []int{
+				digits(FourCardVariant, 0, 0, 0, 0),
+				digits(FourCardVariant, 1, 0, 0, 0),
+				digits(FourCardVariant, 2, 0, 0, 0),
+				digits(FourCardVariant, 3, 0, 0, 0),
+			},
+			want: true,
+		},
+		{
+			name:    "four-card: first and last attributes neither equal nor distinct",
+			variant: FourCardVariant,
+			cards: []int{
+				digits(FourCardVariant, 0, 0, 0, 0),
+				digits(FourCardVariant, 1, 0, 0, 0),
+				digits(FourCardVariant, 2, 0, 0, 0),
+				digits(FourCardVariant, 2, 0, 0, 1),
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMatch(tt.variant, tt.cards); got != tt.want {
+				t.Errorf("isMatch(%v, %v) = %v, want %v", tt.variant, tt.cards, got, tt.want)
+			}
+		})
+	}
+}
+
+// playAndLog plays out a few rounds of a live game (a match claim followed
+// by a hint, repeated until no more matches remain or maxRounds is hit),
+// logging each command the same way Room.loop's logEvent would, and
+// returns the live Game alongside the GameLog that reconstructs it.
+func playAndLog(seed int64, variant Variant, maxRounds int) (*Game, GameLog) {
+	gl := GameLog{Seed: seed, Variant: variant}
+	g := newGame(rand.New(rand.NewSource(seed)), variant)
+	g.add("alice")
+	g.deal()
+	logCmd := func(player string, c Command) {
+		gl.Events = append(gl.Events, LoggedCmd{Seq: len(gl.Events) + 1, Player: player, Command: c})
+	}
+	for i := 0; i < maxRounds; i++ {
+		triples := g.Solver()
+		if len(triples) == 0 {
+			break
+		}
+		claim := CmdClaim{Type: ClaimMatch, Cards: triples[0]}
+		g.claimMatch("alice", claim.Cards)
+		logCmd("alice", claim)
+		if !g.gameover() {
+			g.compact()
+			g.deal()
+		}
+		if triples := g.Solver(); len(triples) > 0 {
+			hint := CmdHint{Penalty: 1}
+			s := g.Players["alice"]
+			s.Score -= hint.Penalty
+			g.Players["alice"] = s
+			logCmd("alice", hint)
+		}
+	}
+	return g, gl
+}
+
+func TestReplayFromMatchesLiveGame(t *testing.T) {
+	live, gl := playAndLog(42, DefaultVariant, 5)
+	replayed := ReplayFrom(gl)
+
+	if len(replayed.Cards) != len(live.Cards) {
+		t.Fatalf("replayed board has %d cards, live game has %d", len(replayed.Cards), len(live.Cards))
+	}
+	for p, c := range live.Cards {
+		if rc, ok := replayed.Cards[p]; !ok || rc != c {
+			t.Errorf("position %v: replayed card %v, want %v", p, rc, c)
+		}
+	}
+	if replayed.deckSize() != live.deckSize() {
+		t.Errorf("replayed deck size = %d, want %d", replayed.deckSize(), live.deckSize())
+	}
+	// Score accounting must balance: every CmdClaim and CmdHint in the log
+	// changed alice's live score, and ReplayFrom must reproduce exactly
+	// that total, hint penalties included.
+	if replayed.Players["alice"].Score != live.Players["alice"].Score {
+		t.Errorf("replayed score = %d, want %d", replayed.Players["alice"].Score, live.Players["alice"].Score)
+	}
+}
+
+// TestSolverNoDuplicateMatches guards the pairIndex dedup in Solver: each
+// triple is reachable via three different pairs, so a missing dedup would
+// report the same match multiple times and inflate countMatches.
+func TestSolverNoDuplicateMatches(t *testing.T) {
+	g := newGame(rand.New(rand.NewSource(7)), DefaultVariant)
+	g.deal()
+	seen := map[[3]int]bool{}
+	for _, triple := range g.Solver() {
+		cards := append([]int(nil), triple...)
+		sort.Ints(cards)
+		key := [3]int{cards[0], cards[1], cards[2]}
+		if seen[key] {
+			t.Errorf("Solver returned duplicate match %v", cards)
+		}
+		seen[key] = true
+	}
+}
+
+func TestVariantDeckSizes(t *testing.T) {
+	tests := []struct {
+		variant Variant
+		want    int
+	}{
+		{DefaultVariant, 81},
+		{FourCardVariant, 256},
+	}
+	for _, tt := range tests {
+		if got := pow(tt.variant.Values, tt.variant.Attributes); got != tt.want {
+			t.Errorf("pow(%d, %d) = %d, want %d", tt.variant.Values, tt.variant.Attributes, got, tt.want)
+		}
+	}
+}